@@ -0,0 +1,490 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package leaderelection
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+
+	"istio.io/istio/pkg/revisions"
+	"istio.io/pkg/log"
+)
+
+var scope = log.RegisterScope("leaderelection", "leader election debugging", 0)
+
+// Various locks used for Istio components. Only one component should use each lock.
+const (
+	NamespaceController = "istio-namespace-controller-election"
+)
+
+// Default lease timing, matching the values recommended for kube-controller-manager style
+// leader election (--leader-elect-lease-duration/-renew-deadline/-retry-period).
+//
+// These are exported so that a command's flag wiring can use them as its defaults, e.g.:
+//
+//	leaseDuration := cmd.PersistentFlags().Duration("leader-elect-lease-duration",
+//	    leaderelection.DefaultLeaseDuration, "...")
+//
+// pilot-discovery's own flag registration isn't part of this package and is out of scope here.
+const (
+	DefaultLeaseDuration = 15 * time.Second
+	DefaultRenewDeadline = 10 * time.Second
+	DefaultRetryPeriod   = 2 * time.Second
+)
+
+// defaultReleaseGracePeriod bounds how long we wait for in-flight run functions to notice they are
+// no longer leading before we release the lock back to the API server. It protects against a run
+// function that never observes its stop channel from wedging the release indefinitely. It is a
+// LeaderElection field, rather than a plain const, solely so tests can shrink it.
+const defaultReleaseGracePeriod = 10 * time.Second
+
+// LeaderElection exposes a subset of the k8s leader election library, allowing callers to add
+// run functions that are executed when the given istiod instance is the leader.
+type LeaderElection struct {
+	namespace  string
+	name       string
+	electionID string
+	client     kubernetes.Interface
+
+	// resourceLock selects the Kubernetes object type backing the lock: one of "leases",
+	// "configmaps" or "configmapsleases". It defaults to leases.
+	resourceLock string
+
+	// leaseDuration is how long a lease is valid for after the last successful renew before
+	// another candidate may acquire it. renewDeadline is how long the current holder will
+	// retry renewing before giving up, and retryPeriod is how often non-leaders check whether
+	// the lock is free. Kubernetes requires retryPeriod < renewDeadline < leaseDuration.
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	// revision is the control plane revision this instance of istiod belongs to. Multiple
+	// revisions may race for the same electionID; the instance running the default revision
+	// is preferred, see defaultWatcher.
+	revision       string
+	defaultWatcher revisions.DefaultWatcher
+
+	runFns []func(stop <-chan struct{})
+
+	// recorder emits Kubernetes Events on the lock object for every leadership transition, the
+	// same way controller-runtime's leader election does. It is nil for LeaderElection values
+	// built directly (e.g. in tests), in which case event emission is skipped.
+	recorder record.EventRecorder
+
+	// isLeaderTracker reflects, in-process, whether we currently believe we hold the lock. It
+	// is flipped to false before the lock is released back to the API server, so that anything
+	// consulting it never observes "I am leader" after the release has been initiated.
+	isLeaderTracker *atomic.Bool
+
+	// lastRenew is the RenewTime of the most recent lock record we observed in which we were
+	// still the recorded holder. It lags behind reality by up to retryPeriod, and stops
+	// advancing entirely once our renewals start failing, which is exactly the staleness
+	// HealthCheck reports on.
+	lastRenew *atomic.Time
+
+	// releaseGracePeriod bounds how long release of the lock waits for in-flight run functions to
+	// stop; see defaultReleaseGracePeriod.
+	releaseGracePeriod time.Duration
+
+	// cycle is bumped every time we (re)create an elector; used for testing.
+	cycle *atomic.Int32
+}
+
+// NewLeaderElection creates a leader election instance scoped to electionID, to be used by the
+// istiod instance called name running revision.
+func NewLeaderElection(namespace, name, electionID, revision string, client kubernetes.Interface) *LeaderElection {
+	return &LeaderElection{
+		namespace:          namespace,
+		name:               name,
+		electionID:         electionID,
+		client:             client,
+		resourceLock:       resourcelock.LeasesResourceLock,
+		leaseDuration:      DefaultLeaseDuration,
+		renewDeadline:      DefaultRenewDeadline,
+		retryPeriod:        DefaultRetryPeriod,
+		revision:           revision,
+		defaultWatcher:     revisions.NewDefaultWatcher(client, revision),
+		recorder:           newEventRecorder(client, "leaderelection"),
+		isLeaderTracker:    atomic.NewBool(false),
+		lastRenew:          atomic.NewTime(time.Time{}),
+		releaseGracePeriod: defaultReleaseGracePeriod,
+		cycle:              atomic.NewInt32(0),
+	}
+}
+
+// newEventRecorder builds an EventRecorder that publishes to the given client, tagged with
+// component as its event source.
+func newEventRecorder(client kubernetes.Interface, component string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component})
+}
+
+// AddRunFunction registers a function to run when elected leader. fn is passed a channel that is
+// closed when the instance loses (or is about to lose) its leader status.
+func (l *LeaderElection) AddRunFunction(fn func(stop <-chan struct{})) *LeaderElection {
+	l.runFns = append(l.runFns, fn)
+	return l
+}
+
+// WithLeaseDuration overrides the default lease duration.
+func (l *LeaderElection) WithLeaseDuration(d time.Duration) *LeaderElection {
+	l.leaseDuration = d
+	return l
+}
+
+// WithRenewDeadline overrides the default renew deadline.
+func (l *LeaderElection) WithRenewDeadline(d time.Duration) *LeaderElection {
+	l.renewDeadline = d
+	return l
+}
+
+// WithRetryPeriod overrides the default retry period.
+func (l *LeaderElection) WithRetryPeriod(d time.Duration) *LeaderElection {
+	l.retryPeriod = d
+	return l
+}
+
+// WithResourceLock overrides the default ResourceLock type ("leases"). lockType must be one of
+// resourcelock.LeasesResourceLock, resourcelock.ConfigMapsResourceLock or
+// resourcelock.ConfigMapsLeasesResourceLock; invalid values are caught by validate().
+func (l *LeaderElection) WithResourceLock(lockType string) *LeaderElection {
+	l.resourceLock = lockType
+	return l
+}
+
+// IsLeader reports whether this instance currently believes it holds the lock.
+func (l *LeaderElection) IsLeader() bool {
+	return l.isLeaderTracker.Load()
+}
+
+// HealthCheck returns a healthz.Checker-style function that fails once this instance is leading
+// but has gone longer than maxLeaseAge since its lock record was last observed fresh. This is the
+// same idea as controller-runtime's NewLeaderHealthzAdaptor: it lets readiness probes (and
+// things like HPAs) distinguish a leader that is silently failing to renew its lease from a
+// healthy standby, instead of reporting healthy as long as the process is merely still running.
+func (l *LeaderElection) HealthCheck(maxLeaseAge time.Duration) func(req *http.Request) error {
+	return func(req *http.Request) error {
+		if !l.IsLeader() {
+			return nil
+		}
+		if age := time.Since(l.lastRenew.Load()); age > maxLeaseAge {
+			return fmt.Errorf("leader %s has not renewed lock %s in %v (max %v)",
+				identity(l.name, l.revision), l.electionID, age, maxLeaseAge)
+		}
+		return nil
+	}
+}
+
+// validate checks that the configured timing satisfies retryPeriod < renewDeadline < leaseDuration,
+// and that resourceLock is one of the lock types resourcelock.New actually supports. Kubernetes'
+// leader election library checks a stricter bound of its own when the elector is created:
+// renewDeadline must exceed JitterFactor*retryPeriod.
+func (l *LeaderElection) validate() error {
+	if l.retryPeriod >= l.renewDeadline {
+		return fmt.Errorf("retry period %v must be less than renew deadline %v", l.retryPeriod, l.renewDeadline)
+	}
+	if l.renewDeadline >= l.leaseDuration {
+		return fmt.Errorf("renew deadline %v must be less than lease duration %v", l.renewDeadline, l.leaseDuration)
+	}
+	switch l.resourceLock {
+	case resourcelock.LeasesResourceLock, resourcelock.ConfigMapsResourceLock, resourcelock.ConfigMapsLeasesResourceLock:
+	default:
+		return fmt.Errorf("unsupported resource lock %q", l.resourceLock)
+	}
+	return nil
+}
+
+// identity encodes the pod name and revision into the value stored as the lock's holder
+// identity, so peers (and operators inspecting the lock) can tell which revision is leading
+// without an extra API call.
+func identity(name, revision string) string {
+	if revision == "" {
+		return name
+	}
+	return name + "." + revision
+}
+
+func splitIdentity(id string) (name, revision string) {
+	if i := strings.LastIndex(id, "."); i >= 0 {
+		return id[:i], id[i+1:]
+	}
+	return id, ""
+}
+
+// event emits a Kubernetes Event on the lock object, mirroring what controller-runtime's leader
+// election does on every transition. It is a no-op if l.recorder is unset.
+func (l *LeaderElection) event(eventType, reason, messageFmt string, args ...interface{}) {
+	if l.recorder == nil {
+		return
+	}
+	l.recorder.Eventf(l.lockObjectReference(), eventType, reason, messageFmt, args...)
+}
+
+// lockObjectReference describes the Kubernetes object backing our lock, for use as an Event's
+// InvolvedObject.
+func (l *LeaderElection) lockObjectReference() *corev1.ObjectReference {
+	kind, apiVersion := "Lease", "coordination.k8s.io/v1"
+	if l.resourceLock == resourcelock.ConfigMapsResourceLock {
+		kind, apiVersion = "ConfigMap", "v1"
+	}
+	return &corev1.ObjectReference{
+		Kind:       kind,
+		APIVersion: apiVersion,
+		Namespace:  l.namespace,
+		Name:       l.electionID,
+	}
+}
+
+func (l *LeaderElection) newLock() (resourcelock.Interface, error) {
+	return resourcelock.New(
+		l.resourceLock,
+		l.namespace,
+		l.electionID,
+		l.client.CoreV1(),
+		l.client.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: identity(l.name, l.revision)},
+	)
+}
+
+// Run starts the leader election loop, blocking until stop is closed.
+func (l *LeaderElection) Run(stop <-chan struct{}) {
+	if err := l.validate(); err != nil {
+		scope.Errorf("invalid leader election configuration for %s: %v", l.electionID, err)
+		return
+	}
+	for {
+		l.cycle.Inc()
+		done, steppedDown := l.run(stop)
+		if done {
+			return
+		}
+		if steppedDown {
+			// We voluntarily gave up the lock in favor of the default revision; pause
+			// so a waiting default-revision instance gets first crack at it instead of
+			// racing it back immediately. A waiting candidate retries every retryPeriod
+			// plus up to JitterFactor*retryPeriod of jitter, so wait out that whole span.
+			time.Sleep(time.Duration(float64(l.retryPeriod) * (1 + leaderelection.JitterFactor)))
+		}
+	}
+}
+
+// run creates a new elector and blocks until it exits, either because stop was closed or because
+// we voluntarily stepped down. It reports which of the two happened.
+func (l *LeaderElection) run(stop <-chan struct{}) (done, steppedDown bool) {
+	lock, err := l.newLock()
+	if err != nil {
+		scope.Errorf("failed to create leader election lock for %s: %v", l.electionID, err)
+		return true, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// acquired and leadingDone track OnStartedLeading separately from le.Run(ctx) returning:
+	// le.Run returns as soon as client-go's internal renew loop observes ctx.Done(), which is
+	// well before our own release handling below has had a chance to finish. acquired is set as
+	// the very first thing OnStartedLeading does, before anything that could block, so it is
+	// reliably true by the time le.Run returns if (and only if) we actually became leader this
+	// cycle; leadingDone is then closed once that callback has released the lock and fully
+	// unwound. run waits on leadingDone (when acquired) before returning, so a new cycle -- this instance
+	// re-acquiring, or a peer -- can never start while a slow run function is still being waited
+	// out here, which would otherwise let that new cycle's release race this one's, exactly the
+	// overlap this package exists to prevent.
+	acquired := atomic.NewBool(false)
+	leadingDone := make(chan struct{})
+	acquireStart := time.Now()
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: l.leaseDuration,
+		RenewDeadline: l.renewDeadline,
+		RetryPeriod:   l.retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				acquired.Store(true)
+				defer close(leadingDone)
+				scope.Infof("%s is now leader of %s", identity(l.name, l.revision), l.electionID)
+				l.isLeaderTracker.Store(true)
+				leaseAcquireDuration.With(lockTag.Value(l.electionID)).Record(time.Since(acquireStart).Seconds())
+				isLeader.With(lockTag.Value(l.electionID), revisionTag.Value(l.revision)).Record(1)
+				leaderTransitions.With(lockTag.Value(l.electionID)).Increment()
+				l.event(corev1.EventTypeNormal, "LeaderElection", "%s became leader of %s",
+					identity(l.name, l.revision), l.electionID)
+				l.lastRenew.Store(time.Now())
+				go l.watchRenewals(ctx, lock)
+				wg := l.runFunctions(ctx.Done())
+				if l.isDefaultRevision() {
+					<-ctx.Done()
+				} else {
+					// We aren't the preferred revision to hold this lock; give a waiting
+					// default-revision instance a chance to take over rather than holding
+					// onto the lock indefinitely.
+					select {
+					case <-ctx.Done():
+					case <-time.After(l.leaseDuration):
+						steppedDown = true
+						// Close the run functions' stop channel (ctx.Done()) ourselves before
+						// waiting on them below; otherwise nothing else signals them to stop on
+						// this voluntary step-down path, and waitWithTimeout would simply stall
+						// for the full grace period before we release the lock.
+						cancel()
+					}
+				}
+				// Flip our in-memory leader status, and wait for the run functions to
+				// observe it, *before* releasing the lock back to the API server. This
+				// closes the window in which a new leader could start duplicate work while
+				// we still believed ourselves to be leading.
+				l.isLeaderTracker.Store(false)
+				isLeader.With(lockTag.Value(l.electionID), revisionTag.Value(l.revision)).Record(0)
+				if !steppedDown {
+					leaseLost.With(lockTag.Value(l.electionID)).Increment()
+					l.event(corev1.EventTypeWarning, "LeaderElectionLost", "%s lost leadership of %s",
+						identity(l.name, l.revision), l.electionID)
+				} else {
+					l.event(corev1.EventTypeNormal, "LeaderElectionStepDown", "%s stepped down from leadership of %s",
+						identity(l.name, l.revision), l.electionID)
+				}
+				waitWithTimeout(wg, l.releaseGracePeriod)
+				l.release(lock)
+			},
+			OnStoppedLeading: func() {
+				scope.Infof("%s stopped leading %s", identity(l.name, l.revision), l.electionID)
+			},
+			OnNewLeader: func(current string) {
+				name, revision := splitIdentity(current)
+				scope.Infof("new leader of %s: %s (revision %s)", l.electionID, name, revision)
+			},
+		},
+		// We release the lock ourselves in OnStartedLeading, once every run function has
+		// stopped, rather than letting client-go release it the instant our context is
+		// canceled; see LeaderElection.release.
+		ReleaseOnCancel: false,
+	})
+	if err != nil {
+		scope.Errorf("failed to create leader elector for %s: %v", l.electionID, err)
+		return true, false
+	}
+	le.Run(ctx)
+	// le.Run returns as soon as client-go's renew loop sees ctx.Done(), which can be well before
+	// OnStartedLeading has finished waiting out run functions and releasing the lock; block here
+	// so the next cycle can't start until that tail is done. See acquired/leadingDone above.
+	if acquired.Load() {
+		<-leadingDone
+	}
+	select {
+	case <-stop:
+		return true, steppedDown
+	default:
+		return false, steppedDown
+	}
+}
+
+// watchRenewals polls the lock record every retryPeriod and, as long as we are still its
+// recorded holder, tracks its RenewTime as lastRenew. It returns once ctx is done.
+func (l *LeaderElection) watchRenewals(ctx context.Context, lock resourcelock.Interface) {
+	ticker := time.NewTicker(l.retryPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current, _, err := lock.Get(context.Background())
+			if err != nil || current == nil || current.HolderIdentity != identity(l.name, l.revision) {
+				continue
+			}
+			l.lastRenew.Store(current.RenewTime.Time)
+		}
+	}
+}
+
+// runFunctions starts each registered run function in its own goroutine and returns a WaitGroup
+// that completes once they have all returned (in response to stop being closed).
+func (l *LeaderElection) runFunctions(stop <-chan struct{}) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	for _, fn := range l.runFns {
+		wg.Add(1)
+		go func(fn func(stop <-chan struct{})) {
+			defer wg.Done()
+			fn(stop)
+		}(fn)
+	}
+	return wg
+}
+
+// waitWithTimeout waits for wg to complete, giving up after timeout so a wedged run function
+// cannot block the release of the lock forever.
+func waitWithTimeout(wg *sync.WaitGroup, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		scope.Warnf("timed out waiting for run functions to stop before releasing the lock")
+	}
+}
+
+// release clears the lock's holder identity so the next candidate can acquire it immediately,
+// instead of waiting out the full lease duration. It is best-effort: if we can no longer reach
+// the API server (for example, the RBAC that let us hold the lock was revoked), there is nothing
+// more we can do, and the lease will simply expire on its own.
+//
+// It is also a no-op if we are no longer the recorded holder. waitWithTimeout can give up on a
+// wedged run function before it actually stops, in which case another cycle -- another peer, or
+// even this instance re-acquiring -- may already hold the lock by the time we get here; clearing
+// HolderIdentity unconditionally would stomp that new holder back to unheld.
+func (l *LeaderElection) release(lock resourcelock.Interface) {
+	current, _, err := lock.Get(context.Background())
+	if err != nil || current == nil {
+		return
+	}
+	if current.HolderIdentity != identity(l.name, l.revision) {
+		return
+	}
+	current.HolderIdentity = ""
+	if err := lock.Update(context.Background(), *current); err != nil {
+		scope.Warnf("failed to release lock %s: %v", l.electionID, err)
+	}
+}
+
+func (l *LeaderElection) isDefaultRevision() bool {
+	if l.defaultWatcher == nil {
+		return true
+	}
+	def := l.defaultWatcher.GetDefault()
+	return def == "" || def == l.revision
+}
@@ -17,6 +17,7 @@ package leaderelection
 import (
 	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -25,26 +26,53 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	k8stesting "k8s.io/client-go/testing"
 
+	"istio.io/istio/pkg/monitoring/monitortest"
 	"istio.io/istio/pkg/revisions"
 	"istio.io/istio/pkg/test/util/retry"
 )
 
 const testLock = "test-lock"
 
+// Default timing used by tests that don't care about the specific lease/renew/retry values.
+const (
+	testLeaseDuration      = time.Second
+	testRenewDeadline      = 500 * time.Millisecond
+	testRetryPeriod        = 100 * time.Millisecond
+	testReleaseGracePeriod = 150 * time.Millisecond
+)
+
 func createElection(t *testing.T, name string, revision string, watcher revisions.DefaultWatcher, expectLeader bool, client kubernetes.Interface,
 	fns ...func(stop <-chan struct{})) (*LeaderElection, chan struct{}) {
+	return createElectionLock(t, name, revision, watcher, expectLeader, client, resourcelock.LeasesResourceLock, fns...)
+}
+
+func createElectionLock(t *testing.T, name string, revision string, watcher revisions.DefaultWatcher, expectLeader bool, client kubernetes.Interface,
+	lockType string, fns ...func(stop <-chan struct{})) (*LeaderElection, chan struct{}) {
+	return createElectionTiming(t, name, revision, watcher, expectLeader, client, lockType,
+		testLeaseDuration, testRenewDeadline, testRetryPeriod, fns...)
+}
+
+func createElectionTiming(t *testing.T, name string, revision string, watcher revisions.DefaultWatcher, expectLeader bool, client kubernetes.Interface,
+	lockType string, lease, renew, retry time.Duration, fns ...func(stop <-chan struct{})) (*LeaderElection, chan struct{}) {
 	t.Helper()
 	l := &LeaderElection{
-		namespace:      "ns",
-		name:           name,
-		electionID:     testLock,
-		client:         client,
-		revision:       revision,
-		defaultWatcher: watcher,
-		ttl:            time.Second,
-		cycle:          atomic.NewInt32(0),
+		namespace:          "ns",
+		name:               name,
+		electionID:         testLock,
+		client:             client,
+		revision:           revision,
+		defaultWatcher:     watcher,
+		resourceLock:       lockType,
+		leaseDuration:      lease,
+		renewDeadline:      renew,
+		retryPeriod:        retry,
+		isLeaderTracker:    atomic.NewBool(false),
+		lastRenew:          atomic.NewTime(time.Time{}),
+		releaseGracePeriod: testReleaseGracePeriod,
+		cycle:              atomic.NewInt32(0),
 	}
 	gotLeader := make(chan struct{})
 	l.AddRunFunction(func(stop <-chan struct{}) {
@@ -123,10 +151,84 @@ func TestPrioritizedLeaderElection(t *testing.T) {
 	close(stop6)
 }
 
+// TestPrioritizedLeaderElectionCustomTiming proves the prioritized-revision takeover semantics
+// from TestPrioritizedLeaderElection hold under a much tighter lease/renew/retry profile than the
+// package defaults, not just the one hardcoded timing used elsewhere in this file.
+func TestPrioritizedLeaderElectionCustomTiming(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	watcher := &fakeDefaultWatcher{defaultRevision: "red"}
+	lease, renew, retry := 300*time.Millisecond, 150*time.Millisecond, 30*time.Millisecond
+
+	// "green" becomes leader first but is not the default revision.
+	_, stop := createElectionTiming(t, "pod1", "green", watcher, true, client, resourcelock.LeasesResourceLock, lease, renew, retry)
+	// "red" is the default revision and steals the lock from "green".
+	_, stop2 := createElectionTiming(t, "pod2", "red", watcher, true, client, resourcelock.LeasesResourceLock, lease, renew, retry)
+	close(stop2)
+	close(stop)
+}
+
+func TestLeaderElectionValidate(t *testing.T) {
+	tests := []struct {
+		name                string
+		lease, renew, retry time.Duration
+		wantErr             bool
+	}{
+		{"valid", 15 * time.Second, 10 * time.Second, 2 * time.Second, false},
+		{"retry equals renew", time.Second, time.Second, time.Second, true},
+		{"renew equals lease", time.Second, time.Second, 100 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLeaderElection("ns", "pod1", testLock, "", fake.NewSimpleClientset()).
+				WithLeaseDuration(tt.lease).WithRenewDeadline(tt.renew).WithRetryPeriod(tt.retry)
+			err := l.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestLeaderElectionWithResourceLock checks that WithResourceLock actually overrides the default
+// ResourceLock, and that validate() rejects anything other than the three types resourcelock.New
+// supports.
+func TestLeaderElectionWithResourceLock(t *testing.T) {
+	l := NewLeaderElection("ns", "pod1", testLock, "", fake.NewSimpleClientset()).
+		WithResourceLock(resourcelock.ConfigMapsResourceLock)
+	if l.resourceLock != resourcelock.ConfigMapsResourceLock {
+		t.Fatalf("WithResourceLock() set resourceLock = %q, want %q", l.resourceLock, resourcelock.ConfigMapsResourceLock)
+	}
+	if err := l.validate(); err != nil {
+		t.Fatalf("validate() error = %v, want nil", err)
+	}
+
+	bad := NewLeaderElection("ns", "pod1", testLock, "", fake.NewSimpleClientset()).WithResourceLock("bogus")
+	if err := bad.validate(); err == nil {
+		t.Fatal("validate() error = nil, want error for unsupported resource lock")
+	}
+}
+
+// TestLeaderElectionResourceLock runs a basic acquire/release cycle matrix-style across every
+// supported ResourceLock type, to make sure all three remain usable against a fake clientset.
+func TestLeaderElectionResourceLock(t *testing.T) {
+	for _, lockType := range []string{
+		resourcelock.LeasesResourceLock,
+		resourcelock.ConfigMapsResourceLock,
+		resourcelock.ConfigMapsLeasesResourceLock,
+	} {
+		t.Run(lockType, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			watcher := &fakeDefaultWatcher{}
+			_, stop := createElectionLock(t, "pod1", "", watcher, true, client, lockType)
+			close(stop)
+		})
+	}
+}
+
 func TestLeaderElectionConfigMapRemoved(t *testing.T) {
 	client := fake.NewSimpleClientset()
 	watcher := &fakeDefaultWatcher{}
-	_, stop := createElection(t, "pod1", "", watcher, true, client)
+	_, stop := createElectionLock(t, "pod1", "", watcher, true, client, resourcelock.ConfigMapsResourceLock)
 	if err := client.CoreV1().ConfigMaps("ns").Delete(context.TODO(), testLock, v1.DeleteOptions{}); err != nil {
 		t.Fatal(err)
 	}
@@ -177,6 +279,252 @@ func TestLeaderElectionNoPermission(t *testing.T) {
 	close(stop)
 }
 
+// TestLeaderElectionNoOverlapOnHandoff is a regression test for the race where a leader's
+// in-memory "am I leader?" state could lag behind the lock actually being released, letting a new
+// leader start work before the old one believed it had stopped. It forces a hand-off the same way
+// TestLeaderElectionNoPermission does (revoking RBAC out from under the current leader) and
+// asserts the two peers' run functions, which write to a shared map standing in for some
+// protected resource, never believe they are both leader at once.
+func TestLeaderElectionNoOverlapOnHandoff(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	watcher := &fakeDefaultWatcher{}
+	allowRbac := atomic.NewBool(true)
+	client.Fake.PrependReactor("update", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if allowRbac.Load() {
+			return false, nil, nil
+		}
+		return true, nil, fmt.Errorf("nope, out of luck")
+	})
+
+	var mu sync.Mutex
+	holders := map[string]bool{}
+	overlap := atomic.NewBool(false)
+	writer := func(name string) func(stop <-chan struct{}) {
+		return func(stop <-chan struct{}) {
+			mu.Lock()
+			if len(holders) > 0 {
+				overlap.Store(true)
+			}
+			holders[name] = true
+			mu.Unlock()
+			<-stop
+			mu.Lock()
+			delete(holders, name)
+			mu.Unlock()
+		}
+	}
+
+	l1, stop1 := createElection(t, "pod1", "", watcher, true, client, writer("pod1"))
+	_, stop2 := createElection(t, "pod2", "", watcher, false, client, writer("pod2"))
+
+	// Revoking RBAC forces pod1 to lose its lease; expect a new cycle to start as it retries.
+	allowRbac.Store(false)
+	expectInt(t, l1.cycle.Load, 2)
+	allowRbac.Store(true)
+
+	// pod2 should take over once the lock is reachable again.
+	retry.UntilSuccessOrFail(t, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !holders["pod2"] {
+			return fmt.Errorf("pod2 has not taken over as leader yet")
+		}
+		return nil
+	})
+
+	if overlap.Load() {
+		t.Fatal("pod1 and pod2 both believed they were leader at the same time")
+	}
+
+	close(stop2)
+}
+
+// TestLeaderElectionNoOverlapOnStepDown is the voluntary-handoff counterpart to
+// TestLeaderElectionNoOverlapOnHandoff: both peers there share a default revision of "", so
+// isDefaultRevision() is always true and the current holder only ever leaves via the involuntary
+// RBAC-revoke path, never the voluntary step-down path taken by a non-default-revision leader once
+// it has held the lock for a full lease duration. That is the path the release-vs-in-memory-state
+// race actually lived in, so exercise it here: "green" leads first but isn't the default revision,
+// and is expected to hand off to "red" without either believing it holds the lock at the same time.
+func TestLeaderElectionNoOverlapOnStepDown(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	watcher := &fakeDefaultWatcher{defaultRevision: "red"}
+	lease, renewDeadline, retryPeriod := 300*time.Millisecond, 150*time.Millisecond, 30*time.Millisecond
+
+	var mu sync.Mutex
+	holders := map[string]bool{}
+	overlap := atomic.NewBool(false)
+	writer := func(name string) func(stop <-chan struct{}) {
+		return func(stop <-chan struct{}) {
+			mu.Lock()
+			if len(holders) > 0 {
+				overlap.Store(true)
+			}
+			holders[name] = true
+			mu.Unlock()
+			<-stop
+			mu.Lock()
+			delete(holders, name)
+			mu.Unlock()
+		}
+	}
+
+	_, stop1 := createElectionTiming(t, "pod1", "green", watcher, true, client, resourcelock.LeasesResourceLock,
+		lease, renewDeadline, retryPeriod, writer("pod1"))
+	_, stop2 := createElectionTiming(t, "pod2", "red", watcher, true, client, resourcelock.LeasesResourceLock,
+		lease, renewDeadline, retryPeriod, writer("pod2"))
+
+	retry.UntilSuccessOrFail(t, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !holders["pod2"] {
+			return fmt.Errorf("pod2 has not taken over as leader yet")
+		}
+		return nil
+	})
+
+	if overlap.Load() {
+		t.Fatal("pod1 and pod2 both believed they were leader at the same time")
+	}
+
+	close(stop2)
+	close(stop1)
+}
+
+// TestLeaderElectionReleaseDoesNotClobberNewHolder is a regression test for release() stomping a
+// newly-acquired holder back to unheld. A run function that is still wedged when
+// releaseGracePeriod elapses does not stop the lock record underneath it from changing hands in
+// the meantime (e.g. because the lease naturally expired while the run function was wedged); this
+// simulates exactly that by installing a different holder identity directly on the lock record
+// while pod1's run function is still asleep, then asserting pod1's eventual, overdue release()
+// call leaves that holder alone instead of clearing it back to "".
+func TestLeaderElectionReleaseDoesNotClobberNewHolder(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	watcher := &fakeDefaultWatcher{}
+
+	slow := func(stop <-chan struct{}) {
+		<-stop
+		// Sleep well past releaseGracePeriod, so waitWithTimeout gives up on us before we return.
+		time.Sleep(2 * testReleaseGracePeriod)
+	}
+	_, stop := createElection(t, "pod1", "", watcher, true, client, slow)
+	close(stop)
+
+	otherLock, err := resourcelock.New(resourcelock.LeasesResourceLock, "ns", testLock,
+		client.CoreV1(), client.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: "someone-else"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Steal the lock record out from under pod1 before it has had a chance to release it itself,
+	// the same way a peer observing a naturally expired lease would.
+	retry.UntilSuccessOrFail(t, func() error {
+		record, _, err := otherLock.Get(context.Background())
+		if err != nil || record == nil {
+			return fmt.Errorf("lock record not found yet: %v", err)
+		}
+		record.HolderIdentity = "someone-else"
+		return otherLock.Update(context.Background(), *record)
+	}, retry.Timeout(time.Second))
+
+	// Give pod1 time to hit releaseGracePeriod and attempt its (now stale) release.
+	time.Sleep(2 * testReleaseGracePeriod)
+
+	record, _, err := otherLock.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.HolderIdentity != "someone-else" {
+		t.Fatalf("release() clobbered the new holder: got %q, want %q", record.HolderIdentity, "someone-else")
+	}
+}
+
+// TestLeaderElectionHealthCheck revokes RBAC (as TestLeaderElectionNoPermission does) and asserts
+// the HealthCheck checker starts failing once the leader has gone longer than maxLeaseAge without
+// a fresh renewal, then recovers once the instance is able to renew (here, reacquire) its lock.
+func TestLeaderElectionHealthCheck(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	watcher := &fakeDefaultWatcher{}
+	allowRbac := atomic.NewBool(true)
+	client.Fake.PrependReactor("update", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if allowRbac.Load() {
+			return false, nil, nil
+		}
+		return true, nil, fmt.Errorf("nope, out of luck")
+	})
+
+	l, stop := createElectionTiming(t, "pod1", "", watcher, true, client, resourcelock.LeasesResourceLock,
+		time.Second, 500*time.Millisecond, 100*time.Millisecond)
+	check := l.HealthCheck(300 * time.Millisecond)
+
+	if err := check(nil); err != nil {
+		t.Fatalf("expected a healthy leader, got %v", err)
+	}
+	if !l.IsLeader() {
+		t.Fatal("expected IsLeader() to report true while leading")
+	}
+
+	allowRbac.Store(false)
+	retry.UntilSuccessOrFail(t, func() error {
+		if err := check(nil); err == nil {
+			return fmt.Errorf("expected health check to start failing once renewals stop")
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+
+	allowRbac.Store(true)
+	retry.UntilSuccessOrFail(t, func() error {
+		if !l.IsLeader() {
+			return fmt.Errorf("expected pod1 to reacquire its lock")
+		}
+		return check(nil)
+	}, retry.Timeout(5*time.Second))
+
+	close(stop)
+}
+
+// TestLeaderElectionMetrics asserts the leader_election_leader_transitions_total counter
+// advances as the lock is stolen across the prioritized-revision steal scenario from
+// TestPrioritizedLeaderElection.
+func TestLeaderElectionMetrics(t *testing.T) {
+	mt := monitortest.New(t)
+	client := fake.NewSimpleClientset()
+	watcher := &fakeDefaultWatcher{defaultRevision: "red"}
+
+	_, stop := createElection(t, "pod1", "green", watcher, true, client)
+	_, stop2 := createElection(t, "pod2", "red", watcher, true, client)
+
+	mt.Assert(leaderTransitions.Name(), map[string]string{"lock": testLock}, 2)
+
+	close(stop2)
+	close(stop)
+}
+
+// TestLeaderElectionNoPermissionMetrics asserts leader_election_lease_lost_total advances when a
+// leader involuntarily loses its lease, reusing the RBAC-revoke cycle from
+// TestLeaderElectionNoPermission.
+func TestLeaderElectionNoPermissionMetrics(t *testing.T) {
+	mt := monitortest.New(t)
+	client := fake.NewSimpleClientset()
+	watcher := &fakeDefaultWatcher{}
+	allowRbac := atomic.NewBool(true)
+	client.Fake.PrependReactor("update", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if allowRbac.Load() {
+			return false, nil, nil
+		}
+		return true, nil, fmt.Errorf("nope, out of luck")
+	})
+
+	l, stop := createElection(t, "pod1", "", watcher, true, client)
+	allowRbac.Store(false)
+	expectInt(t, l.cycle.Load, 2)
+	allowRbac.Store(true)
+	expectInt(t, l.cycle.Load, 2)
+
+	mt.Assert(leaseLost.Name(), map[string]string{"lock": testLock}, 1)
+
+	close(stop)
+}
+
 func expectInt(t *testing.T, f func() int32, expected int32) {
 	t.Helper()
 	retry.UntilSuccessOrFail(t, func() error {
@@ -0,0 +1,58 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package leaderelection
+
+import (
+	"istio.io/istio/pkg/monitoring"
+)
+
+var (
+	lockTag     = monitoring.MustCreateLabel("lock")
+	revisionTag = monitoring.MustCreateLabel("revision")
+)
+
+var (
+	// isLeader reports, per lock/revision, whether this instance currently believes it holds
+	// the lock (1) or not (0). It mirrors isLeaderTracker so it can be scraped externally.
+	isLeader = monitoring.NewGauge(
+		"leader_election_is_leader",
+		"1 if this instance currently holds the given leader election lock, 0 otherwise",
+		monitoring.WithLabels(lockTag, revisionTag),
+	)
+
+	leaderTransitions = monitoring.NewSum(
+		"leader_election_leader_transitions_total",
+		"Number of times this instance has become the leader of a given lock",
+		monitoring.WithLabels(lockTag),
+	)
+
+	leaseAcquireDuration = monitoring.NewDistribution(
+		"leader_election_lease_acquire_duration_seconds",
+		"Time taken to acquire a leader election lock, from when acquisition was first attempted",
+		[]float64{.1, .25, .5, 1, 2.5, 5, 10, 15, 30, 60},
+		monitoring.WithLabels(lockTag),
+	)
+
+	leaseLost = monitoring.NewSum(
+		"leader_election_lease_lost_total",
+		"Number of times this instance lost a lease it had previously acquired, rather than "+
+			"voluntarily stepping down",
+		monitoring.WithLabels(lockTag),
+	)
+)
+
+func init() {
+	monitoring.MustRegister(isLeader, leaderTransitions, leaseAcquireDuration, leaseLost)
+}